@@ -0,0 +1,346 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Request bodies are streamed to handlers straight off the connection. The
+// readers here apply the framing (Content-Length or chunked), remove any
+// further transfer codings and enforce the body size limit as the handler
+// reads, so nothing is buffered up front.
+//
+// Their errors follow the request parser: errMalformedRequest for bad
+// framing, errIncompleteRequest when the client stops short, errBodyTooLarge
+// past the limit.
+
+// newBodyReader returns the body framed by req's Transfer-Encoding or
+// Content-Length headers, reading from r.
+func newBodyReader(r byteReader, req *Request, limits *LimitsConfig) (io.Reader, error) {
+	if te := req.Header("Transfer-Encoding"); te != "" {
+		body, err := transferDecoder(r, req, te, limits)
+		if err != nil {
+			return nil, err
+		}
+		// Handlers see the decoded body, so the framing no longer applies.
+		delete(req.Headers, "Transfer-Encoding")
+		if req.Header("Content-Length") != "" {
+			// Transfer-Encoding wins (RFC 9112 section 6.1), but a peer
+			// that framed by the length would read the rest of this body
+			// as another request. Don't serve anything after it.
+			delete(req.Headers, "Content-Length")
+			req.closeConn = true
+		}
+		return &maxBytesReader{r: body, remaining: limits.MaxBodyBytes, limit: limits.MaxBodyBytes}, nil
+	}
+
+	cl := req.Header("Content-Length")
+	if cl == "" {
+		if req.Method == "POST" || req.Method == "PUT" {
+			// Without a length there's no knowing where an upload ends.
+			return nil, errLengthRequired
+		}
+		return &fixedLengthReader{}, nil
+	}
+	length, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: bad Content-Length %q", errMalformedRequest, cl)
+	}
+	if length > limits.MaxBodyBytes {
+		return nil, fmt.Errorf("%w: Content-Length %d exceeds %d", errBodyTooLarge, length, limits.MaxBodyBytes)
+	}
+	return &fixedLengthReader{r: r, remaining: length}, nil
+}
+
+// transferDecoder undoes the codings listed in a Transfer-Encoding header.
+// Codings are listed in the order they were applied, so they are removed
+// last to first. chunked must be the final coding, since otherwise the
+// request has no way to mark where it ends.
+func transferDecoder(r byteReader, req *Request, header string, limits *LimitsConfig) (io.Reader, error) {
+	var codings []string
+	for _, coding := range strings.Split(header, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+		return nil, fmt.Errorf("%w: Transfer-Encoding must end in chunked", errMalformedRequest)
+	}
+
+	var body io.Reader = &chunkedReader{r: r, maxLine: limits.MaxChunkLine, maxTrailerBytes: limits.MaxHeaderBytes, maxTrailerCount: limits.MaxHeaderCount, trailers: declaredTrailers(req), headers: req.Headers}
+	for i := len(codings) - 2; i >= 0; i-- {
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			body = &gzipBodyReader{r: body}
+		default:
+			return nil, errUnsupportedTransferCoding
+		}
+	}
+	return body, nil
+}
+
+// fixedLengthReader yields exactly remaining bytes. Unlike io.LimitReader it
+// treats running out early as an error, not a short body.
+type fixedLengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (f *fixedLengthReader) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= int64(n)
+	if err == io.EOF && f.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("%w: body: %w", errIncompleteRequest, err)
+	}
+	return n, err
+}
+
+// maxBytesReader fails with errBodyTooLarge once more than limit bytes have
+// come through, so an oversized body is rejected rather than truncated.
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, fmt.Errorf("%w: body exceeds %d bytes", errBodyTooLarge, m.limit)
+	}
+	// Ask for one byte more than allowed so we can tell "exactly at the limit"
+	// from "over it".
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.remaining {
+		n = int(m.remaining)
+		m.remaining = -1
+		return n, fmt.Errorf("%w: body exceeds %d bytes", errBodyTooLarge, m.limit)
+	}
+	m.remaining -= int64(n)
+	return n, err
+}
+
+// contextReader fails with the context's error once it is done, so a body
+// still trickling in when the request's time runs out is abandoned.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// utf8Reader fails with errMalformedRequest at the first invalid UTF-8 in
+// its input. A sequence split across reads is held back until it's whole.
+type utf8Reader struct {
+	r       io.Reader
+	pending []byte
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	data := append(u.pending, p[:n]...)
+	whole := len(data)
+	for i := len(data) - 1; i >= 0 && i > len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				whole = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(data[:whole]) || (err == io.EOF && whole < len(data)) {
+		return n, fmt.Errorf("%w: body is not valid UTF-8", errMalformedRequest)
+	}
+	u.pending = append([]byte(nil), data[whole:]...)
+	return n, err
+}
+
+// gzipBodyReader gunzips its input, deferring the gzip header read until the
+// handler first asks for data.
+type gzipBodyReader struct {
+	r  io.Reader
+	zr *gzip.Reader
+}
+
+func (g *gzipBodyReader) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, gzipError(err)
+		}
+		g.zr = zr
+	}
+	n, err := g.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = gzipError(err)
+	}
+	return n, err
+}
+
+// gzipError passes through errors from the reader underneath and reports
+// anything else as a corrupt body.
+func gzipError(err error) error {
+	if errors.Is(err, errIncompleteRequest) || errors.Is(err, errMalformedRequest) || errors.Is(err, errBodyTooLarge) || errors.Is(err, errHeadersTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: gzip: %v", errMalformedRequest, err)
+}
+
+// trailerForbidden lists fields a trailer may not set: they frame or route
+// the request and were acted on before the body was read.
+var trailerForbidden = map[string]bool{
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Content-Type":      true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+	"Host":              true,
+	"Expect":            true,
+	"Connection":        true,
+}
+
+// declaredTrailers returns the fields req's Trailer header announces,
+// canonicalized, leaving out any a trailer isn't allowed to carry.
+func declaredTrailers(req *Request) map[string]bool {
+	declared := make(map[string]bool)
+	for _, name := range strings.Split(req.Header("Trailer"), ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if name != "" && !trailerForbidden[name] {
+			declared[name] = true
+		}
+	}
+	return declared
+}
+
+// chunkedReader decodes a chunked body through the terminating zero-size
+// chunk and its trailer section. Trailer fields named in trailers are merged
+// into headers as they are read; anything undeclared is dropped. The trailer
+// section is held to the same size and line limits as the header section.
+type chunkedReader struct {
+	r               byteReader
+	maxLine         int
+	maxTrailerBytes int
+	maxTrailerCount int
+	trailers        map[string]bool
+	headers         map[string]string
+	// left is what remains of the current chunk.
+	left int64
+	done bool
+	err  error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		c.err = fmt.Errorf("%w: chunk: %w", errIncompleteRequest, err)
+		return n, c.err
+	}
+	if c.left == 0 {
+		if crlf, err := readLine(c.r, c.maxLine); err != nil {
+			c.err = lineError("chunk", err)
+		} else if strings.TrimRight(crlf, "\r\n") != "" {
+			c.err = fmt.Errorf("%w: chunk longer than its size", errMalformedRequest)
+		}
+		if c.err != nil {
+			return n, c.err
+		}
+	}
+	return n, nil
+}
+
+// nextChunk reads the next chunk-size line, and the trailer section once
+// the last chunk has been seen.
+func (c *chunkedReader) nextChunk() error {
+	line, err := readLine(c.r, c.maxLine)
+	if err != nil {
+		return lineError("chunk size", err)
+	}
+	sizeField, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: bad chunk size %q", errMalformedRequest, sizeField)
+	}
+	if size > 0 {
+		c.left = size
+		return nil
+	}
+
+	c.done = true
+	trailerBytes, trailerCount := 0, 0
+	for {
+		line, err := readLine(c.r, c.maxTrailerBytes-trailerBytes)
+		if err == io.EOF {
+			// Tolerate a missing final CRLF.
+			return nil
+		} else if errors.Is(err, errLineTooLong) {
+			return fmt.Errorf("%w: trailer section over %d bytes", errHeadersTooLarge, c.maxTrailerBytes)
+		} else if err != nil {
+			return lineError("trailer", err)
+		}
+		trailerBytes += len(line)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return nil
+		}
+		if trailerCount == c.maxTrailerCount {
+			return fmt.Errorf("%w: more than %d trailer lines", errHeadersTooLarge, c.maxTrailerCount)
+		}
+		trailerCount++
+		fields, err := parseHeaders([]string{line})
+		if err != nil {
+			return err
+		}
+		for name, value := range fields {
+			if c.trailers[name] {
+				c.headers[name] = value
+			}
+		}
+	}
+}
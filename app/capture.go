@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCaptureBytes caps how much of any single request --debug-capture keeps.
+const maxCaptureBytes = 4096
+
+// captures holds the most recent raw requests when --debug-capture is set.
+var captures *captureRing
+
+type capturedRequest struct {
+	remote    string
+	at        time.Time
+	raw       []byte
+	truncated bool
+}
+
+// captureRing is a fixed-size ring of raw requests, oldest overwritten first.
+type captureRing struct {
+	mu      sync.Mutex
+	entries []capturedRequest
+	next    int
+	full    bool
+}
+
+func newCaptureRing(size int) *captureRing {
+	return &captureRing{entries: make([]capturedRequest, size)}
+}
+
+func (c *captureRing) add(remote net.Addr, raw []byte) {
+	if len(raw) == 0 {
+		return
+	}
+	entry := capturedRequest{remote: remote.String(), at: time.Now()}
+	if len(raw) > maxCaptureBytes {
+		raw, entry.truncated = raw[:maxCaptureBytes], true
+	}
+	entry.raw = append([]byte(nil), raw...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.next] = entry
+	c.next = (c.next + 1) % len(c.entries)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// dump renders the captured requests oldest first, each verbatim under a
+// separator line.
+func (c *captureRing) dump() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start, count := 0, c.next
+	if c.full {
+		start, count = c.next, len(c.entries)
+	}
+	var sb strings.Builder
+	for i := 0; i < count; i++ {
+		entry := c.entries[(start+i)%len(c.entries)]
+		fmt.Fprintf(&sb, "----- %s from %s (%d bytes", entry.at.UTC().Format(time.RFC3339Nano), entry.remote, len(entry.raw))
+		if entry.truncated {
+			sb.WriteString(", truncated")
+		}
+		sb.WriteString(") -----\n")
+		sb.Write(entry.raw)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// byteReader is what the request parser reads from: the connection's
+// bufio.Reader, or a recordingReader around it.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// recordingReader keeps a copy of every byte the parser consumes, up to
+// maxCaptureBytes.
+type recordingReader struct {
+	r   byteReader
+	buf bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.record(p[:n]...)
+	return n, err
+}
+
+func (rr *recordingReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.record(b)
+	}
+	return b, err
+}
+
+func (rr *recordingReader) record(p ...byte) {
+	// Keep one byte past the cap so add can tell the request was truncated.
+	if room := maxCaptureBytes + 1 - rr.buf.Len(); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		rr.buf.Write(p)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// ipLimiter caps how many connections a single client IP may hold open at
+// once, for --max-conns-per-ip.
+type ipLimiter struct {
+	mu   sync.Mutex
+	max  int
+	open map[string]int
+}
+
+func newIPLimiter(max int) *ipLimiter {
+	return &ipLimiter{max: max, open: make(map[string]int)}
+}
+
+// acquire counts a new connection from remote, reporting false (and
+// counting nothing) when that IP is already at the limit.
+func (l *ipLimiter) acquire(remote net.Addr) bool {
+	ip := remoteIP(remote)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	return true
+}
+
+// release gives back a connection counted by acquire.
+func (l *ipLimiter) release(remote net.Addr) {
+	ip := remoteIP(remote)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+// remoteIP strips the port from a peer address, so every connection from
+// one client shares a key.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The handlers in this file mirror httpbin.org endpoints that are handy for
+// exercising HTTP clients.
+
+// jsonResponse serializes v as an indented JSON 200 response.
+func jsonResponse(req *Request, cfg *Config, v any) string {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		errorf("Error encoding JSON for %s: %v", req.Path, err)
+		return errorResponse(req, cfg, 500, "could not encode the response")
+	}
+	body = append(body, '\n')
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", "application/json")
+	rw.Write(body)
+	return rw.String()
+}
+
+// parseCookies splits a Cookie header ("a=1; b=2") into its pairs.
+// Entries without a name are skipped.
+func parseCookies(header string) map[string]string {
+	cookies := make(map[string]string)
+	for _, pair := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if name == "" {
+			continue
+		}
+		cookies[name] = strings.Trim(value, `"`)
+	}
+	return cookies
+}
+
+func handleCookiesRequest(conn net.Conn, req *Request, cfg *Config) string {
+	return jsonResponse(req, cfg, map[string]any{"cookies": parseCookies(req.Header("Cookie"))})
+}
+
+// handleSetCookiesRequest answers /cookies/set?name=value&... with one
+// Set-Cookie per parameter. Values are percent-encoded so characters that
+// aren't legal in a cookie value (spaces, quotes, ';', ',') survive.
+func handleSetCookiesRequest(conn net.Conn, req *Request, cfg *Config) string {
+	query := req.Query
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != "" && !strings.ContainsFunc(name, isNotTokenChar) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	set := make(map[string]string, len(names))
+	for _, name := range names {
+		set[name] = url.PathEscape(query.Get(name))
+	}
+	res := jsonResponse(req, cfg, map[string]any{"cookies": set})
+	for _, name := range names {
+		res = withHeader(res, "Set-Cookie", name+"="+set[name]+"; Path=/")
+	}
+	return res
+}
+
+// handleBasicAuthRequest serves /basic-auth/<user>/<pass>, which succeeds
+// only for a request carrying exactly those Basic credentials.
+func handleBasicAuthRequest(conn net.Conn, req *Request, cfg *Config) string {
+	parts := strings.Split(strings.TrimPrefix(req.Path, "/basic-auth/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return errorResponse(req, cfg, 404, "use /basic-auth/<user>/<password>")
+	}
+	user, pass := parts[0], parts[1]
+
+	gotUser, gotPass, ok := basicAuth(req)
+	if !ok || subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(gotPass), []byte(pass)) != 1 {
+		res := errorResponse(req, cfg, 401, "credentials do not match")
+		return withHeader(res, "WWW-Authenticate", `Basic realm="Fake Realm"`)
+	}
+	return jsonResponse(req, cfg, map[string]any{"authenticated": true, "user": user})
+}
+
+// basicAuth decodes the credentials of a Basic Authorization header.
+func basicAuth(req *Request) (user, pass string, ok bool) {
+	scheme, encoded, found := strings.Cut(req.Header("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// handleRedirectRequest serves /redirect/<n>: each hop answers 302 to
+// /redirect/<n-1> until /redirect/0 finally returns 200.
+func handleRedirectRequest(conn net.Conn, req *Request, cfg *Config) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(req.Path, "/redirect/"))
+	if err != nil || n < 0 {
+		return errorResponse(req, cfg, 400, "use /redirect/<n> with n >= 0")
+	}
+	if n == 0 {
+		contentType, res := textContentType(req, cfg)
+		if res != "" {
+			return res
+		}
+		body := "redirects done\n"
+		rw := &responseWriter{}
+		rw.SetHeader("Content-Type", contentType)
+		rw.WriteString(body)
+		return rw.String()
+	}
+	rw := &responseWriter{}
+	rw.WriteHeader(302)
+	rw.SetHeader("Location", "/redirect/"+strconv.Itoa(n-1))
+	return rw.String()
+}
+
+// handleAnythingRequest serves /anything (and anything below it) by
+// reflecting the whole request back as JSON.
+func handleAnythingRequest(conn net.Conn, req *Request, cfg *Config) string {
+	// Read one byte past the cap to tell a body that fits exactly from one
+	// that doesn't; the rest is drained unread after we answer.
+	body, err := io.ReadAll(io.LimitReader(req.Body, cfg.MaxAnythingBody+1))
+	if err != nil {
+		return bodyErrorResponse(req, cfg, err)
+	}
+	truncated := int64(len(body)) > cfg.MaxAnythingBody
+	if truncated {
+		body = body[:cfg.MaxAnythingBody]
+	}
+	return jsonResponse(req, cfg, map[string]any{
+		"method":         req.Method,
+		"path":           req.Path,
+		"args":           req.Query,
+		"headers":        req.Headers,
+		"body":           string(body),
+		"body_truncated": truncated,
+	})
+}
+
+// handleIPRequest serves /ip with the client's address. Behind a proxy
+// that address is the proxy's, so with --trust-forwarded-for the first
+// X-Forwarded-For entry is reported instead.
+func handleIPRequest(conn net.Conn, req *Request, cfg *Config) string {
+	return jsonResponse(req, cfg, map[string]any{"origin": clientIP(conn, req, cfg)})
+}
+
+func clientIP(conn net.Conn, req *Request, cfg *Config) string {
+	if cfg.TrustForwardedFor {
+		first, _, _ := strings.Cut(req.Header("X-Forwarded-For"), ",")
+		if first = strings.TrimSpace(first); first != "" {
+			return first
+		}
+	}
+	return remoteIP(conn.RemoteAddr())
+}
+
+// handleGetRequest serves /get: the query, headers and client address of
+// the request as JSON.
+func handleGetRequest(conn net.Conn, req *Request, cfg *Config) string {
+	target := req.Path
+	if req.RawQuery != "" {
+		target += "?" + req.RawQuery
+	}
+	return jsonResponse(req, cfg, map[string]any{
+		"args":    req.Query,
+		"headers": req.Headers,
+		"origin":  clientIP(conn, req, cfg),
+		"url":     target,
+	})
+}
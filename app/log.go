@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// logLevelFlag lets --log-level be parsed straight into a logLevel.
+type logLevelFlag struct {
+	level *logLevel
+}
+
+func (f logLevelFlag) String() string {
+	if f.level == nil {
+		return levelInfo.String()
+	}
+	return f.level.String()
+}
+
+func (f logLevelFlag) Set(s string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			*f.level = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q (want one of %s)", s, strings.Join(levelNames, ", "))
+}
+
+var (
+	minLogLevel = levelInfo
+	// logTimeFormat is the time.Format layout each line starts with; empty
+	// leaves timestamps off. The default is RFC 3339 with milliseconds.
+	logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+	logger        = log.New(os.Stdout, "", 0)
+)
+
+func logf(level logLevel, format string, args ...any) {
+	if level < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf("[%s] %s", level, fmt.Sprintf(format, args...))
+	if logTimeFormat != "" {
+		msg = time.Now().Format(logTimeFormat) + " " + msg
+	}
+	logger.Print(msg)
+}
+
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(levelError, format, args...) }
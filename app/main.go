@@ -1,160 +1,1563 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"mime"
 	"net"
+	"net/textproto"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Ensures gofmt doesn't remove the "net" and "os" imports above (feel free to remove this!)
 var _ = net.Listen
 var _ = os.Exit
 
-func comperessData(data string) bytes.Buffer {
-	var buf bytes.Buffer
-	writer := gzip.NewWriter(&buf)
+func compressData(data, coding string, level int) string {
+	buf := compressBuffers.Get().(*bytes.Buffer)
+	defer compressBuffers.Put(buf)
+	buf.Reset()
+	writer := newEncoder(buf, coding, level)
+	defer releaseEncoder(writer, coding, level)
 	_, err := writer.Write([]byte(data))
 	if err != nil {
 		panic(err)
 	}
 	writer.Close()
-	fmt.Println("Buffer: ", buf)
-	return buf
+	return buf.String()
+}
+
+// encoder is a compressing writer that can be reused through Reset, as
+// both *gzip.Writer and *zlib.Writer can.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Allocating a compressor costs far more than compressing a short body,
+// so they, and compressData's buffers, are pooled across requests. A reset
+// encoder keeps its level, so there's a pool per coding and level.
+var (
+	encoderPools    sync.Map // encoderKey -> *sync.Pool
+	compressBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+type encoderKey struct {
+	deflate bool
+	level   int
+}
+
+func encoderPool(coding string, level int) *sync.Pool {
+	key := encoderKey{deflate: coding == "deflate", level: level}
+	if pool, ok := encoderPools.Load(key); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := encoderPools.LoadOrStore(key, &sync.Pool{New: func() any {
+		// --gzip-level is checked at startup, so the level is valid.
+		if key.deflate {
+			zw, _ := zlib.NewWriterLevel(nil, level)
+			return zw
+		}
+		zw, _ := gzip.NewWriterLevel(nil, level)
+		return zw
+	}})
+	return pool.(*sync.Pool)
+}
+
+// newEncoder returns a writer applying the content coding chosen by
+// selectEncoding at the given compression level. HTTP's "deflate" is the
+// zlib format, not a raw deflate stream. Hand it back with releaseEncoder
+// once it's closed.
+func newEncoder(w io.Writer, coding string, level int) encoder {
+	zw := encoderPool(coding, level).Get().(encoder)
+	zw.Reset(w)
+	return zw
+}
+
+// releaseEncoder returns an encoder from newEncoder to its pool. Reset
+// clears any state, so one abandoned mid-stream is still safe to reuse.
+func releaseEncoder(zw encoder, coding string, level int) {
+	zw.Reset(nil)
+	encoderPool(coding, level).Put(zw)
+}
+
+// Config holds the operator-supplied server settings.
+type Config struct {
+	Dir           string
+	FilesPrefix   string
+	MaxEchoLength int
+	ReuseAddr     bool
+	Headers       headerFlag
+	Listen        listenFlag
+	ProblemJSON   bool
+	Limits        LimitsConfig
+	MaxFiles      int
+	GzipMin       int
+	GzipLevel     int
+	RobotsFile    string
+	SecurityFile  string
+	NoKeepAlive   bool
+	DebugCapture  int
+	Timeout       time.Duration
+	StrictSlash   bool
+	MaxConnsPerIP int
+	NoSniff       bool
+	ValidateUTF8  bool
+	EmptyEcho204  bool
+	// TrustForwardedFor makes /ip believe X-Forwarded-For, for servers
+	// that only ever sit behind a proxy that sets it.
+	TrustForwardedFor bool
+	// GetBody says what to do with a body sent on GET or HEAD: "drain" it
+	// unread, or "reject" the request.
+	GetBody string
+	// MaxAnythingBody caps how much of a body /anything reflects back.
+	MaxAnythingBody int64
+	// MaxDuration bounds the whole of a request, body included, from when
+	// its headers arrive.
+	MaxDuration time.Duration
+	// ReadBuffer and WriteBuffer size the kernel socket buffers of each
+	// accepted TCP connection; 0 keeps the OS default.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// rootResponse is the finished keep-alive reply to GET /, built once
+	// since nothing but the Date varies between requests. It stops short
+	// of the blank line, so the Date can be appended.
+	rootResponse []byte
+	// CompressibleTypes are the media types gzip is applied to, lowercased;
+	// "type/*" entries match a whole type.
+	CompressibleTypes []string
+	// Charsets maps lowercased media types, or "type/*" for a whole type,
+	// to the charset files of that type are labelled with; "" means none.
+	Charsets map[string]string
+}
+
+// LimitsConfig bounds the size of incoming requests. Every field must be
+// positive.
+type LimitsConfig struct {
+	MaxRequestLine int   // longer request lines get 414
+	MaxHeaderBytes int   // header sections larger than this get 431
+	MaxHeaderCount int   // more header lines than this get 431
+	MaxBodyBytes   int64 // larger (decoded) bodies get 413
+	MaxChunkLine   int   // longer chunk-size lines get 400
+}
+
+// responseHeader is a header the operator asked to add to every response.
+type responseHeader struct {
+	Name  string
+	Value string
+}
+
+// isNotTokenChar reports whether r may not appear in a header name.
+func isNotTokenChar(r rune) bool {
+	return r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r)
+}
+
+// reservedHeaders are the names --header may not set: the server frames
+// and dates every response itself, and hop-by-hop fields describe the
+// connection rather than the response.
+var reservedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Upgrade":           true,
+}
+
+// headerFlag collects repeated --header "Name: Value" flags.
+type headerFlag []responseHeader
+
+func (h *headerFlag) String() string {
+	var parts []string
+	for _, header := range *h {
+		parts = append(parts, header.Name+": "+header.Value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h *headerFlag) Set(s string) error {
+	name, value, found := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !found || name == "" {
+		return fmt.Errorf("expected \"Name: Value\", got %q", s)
+	}
+	if strings.ContainsFunc(name, isNotTokenChar) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header value for %s must not contain line breaks", name)
+	}
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if reservedHeaders[name] {
+		return fmt.Errorf("%s is set by the server and cannot be given with --header", name)
+	}
+	*h = append(*h, responseHeader{Name: name, Value: value})
+	return nil
+}
+
+// has reports whether the operator set the named header themselves.
+func (h headerFlag) has(name string) bool {
+	for _, header := range h {
+		if strings.EqualFold(header.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenFlag collects repeated --listen addresses.
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listenFlag) Set(s string) error {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return err
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+func parseFlags() *Config {
+	cfg := &Config{}
+	flag.StringVar(&cfg.Dir, "directory", "", "directory served by the files route")
+	flag.StringVar(&cfg.FilesPrefix, "files-prefix", "/files", "URL prefix the files route is mounted under")
+	flag.BoolVar(&cfg.ReuseAddr, "reuseaddr", true, "set SO_REUSEADDR on the listening socket so restarts can rebind immediately (Unix only)")
+	flag.BoolVar(&cfg.EmptyEcho204, "empty-echo-204", false, "answer an /echo/ with nothing to echo with 204 No Content instead of an empty 200")
+	flag.IntVar(&cfg.MaxEchoLength, "max-echo", 1024, "longest string /echo will reflect back (0 disables the limit)")
+	flag.BoolVar(&cfg.ProblemJSON, "problem-json", false, "send RFC 7807 application/problem+json error bodies to clients that accept them")
+	flag.IntVar(&cfg.Limits.MaxRequestLine, "max-request-line", 8192, "longest request line accepted (414 beyond it)")
+	flag.IntVar(&cfg.Limits.MaxHeaderBytes, "max-header-bytes", 32<<10, "largest header section accepted (431 beyond it)")
+	flag.IntVar(&cfg.Limits.MaxHeaderCount, "max-header-count", 100, "most header lines accepted (431 beyond it)")
+	flag.Int64Var(&cfg.Limits.MaxBodyBytes, "max-body", 10<<20, "largest request body accepted, after decoding (413 beyond it)")
+	flag.IntVar(&cfg.Limits.MaxChunkLine, "max-chunk-line", 4096, "longest chunk-size line accepted in a chunked request body")
+	flag.IntVar(&cfg.MaxFiles, "max-upload-files", 0, "most files the serve directory may hold before uploads get 507 (0 disables the limit)")
+	compressibleTypes := flag.String("compressible-types", "text/*,application/json,application/javascript,application/xml,image/svg+xml", "comma-separated media types worth gzipping for clients that accept it (type/* matches a whole type)")
+	charsets := flag.String("charsets", "text/*=utf-8", "comma-separated type=charset pairs labelling served files (type/* matches a whole type; an empty charset sends none)")
+	flag.IntVar(&cfg.GzipLevel, "gzip-level", 6, "compression level for gzip and deflate responses, from 1 (fastest) to 9 (smallest)")
+	flag.IntVar(&cfg.GzipMin, "gzip-min", 256, "echo bodies shorter than this are sent uncompressed even to clients that accept gzip")
+	flag.BoolVar(&cfg.NoSniff, "nosniff", false, "send X-Content-Type-Options: nosniff on files route responses")
+	flag.StringVar(&cfg.GetBody, "get-body", "drain", "what to do with a body on GET or HEAD: drain (read and ignore it) or reject (400)")
+	flag.BoolVar(&cfg.ValidateUTF8, "validate-utf8", false, "reject text/* uploads declared charset=utf-8 whose body isn't valid UTF-8 (400)")
+	flag.Int64Var(&cfg.MaxAnythingBody, "max-anything-body", 64<<10, "most body bytes /anything reflects; longer bodies are cut off and flagged body_truncated")
+	flag.StringVar(&cfg.RobotsFile, "robots", "", "file served at /robots.txt (404 when unset)")
+	flag.StringVar(&cfg.SecurityFile, "security-txt", "", "file served at /.well-known/security.txt (404 when unset)")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", 0, "most connections one client IP may hold open; extra ones are closed on accept (0 disables)")
+	flag.BoolVar(&cfg.TrustForwardedFor, "trust-forwarded-for", false, "report the X-Forwarded-For client at /ip instead of the peer address (only behind a trusted proxy)")
+	flag.IntVar(&cfg.ReadBuffer, "tcp-read-buffer", 0, "socket receive buffer size in bytes for accepted connections (0 keeps the OS default)")
+	flag.IntVar(&cfg.WriteBuffer, "tcp-write-buffer", 0, "socket send buffer size in bytes for accepted connections (0 keeps the OS default)")
+	flag.BoolVar(&cfg.NoKeepAlive, "no-keepalive", false, "close every connection after one request")
+	flag.IntVar(&cfg.DebugCapture, "debug-capture", 0, "keep the last N raw requests and show them at /debug/requests (0 disables)")
+	flag.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "how long a client may take to send each request, or to accept each response write (0 disables)")
+	flag.BoolVar(&cfg.StrictSlash, "strict-slash", false, "301-redirect paths with a missing or extra trailing slash to the route's own form instead of serving them directly")
+	flag.DurationVar(&cfg.MaxDuration, "max-request-duration", 0, "longest a request may take to handle, body included; slower ones get 503 (0 disables)")
+	flag.Var(logLevelFlag{&minLogLevel}, "log-level", "minimum level logged: debug, info, warn or error")
+	flag.StringVar(&logTimeFormat, "log-time-format", logTimeFormat, "Go time layout stamped at the start of each log line (empty for none)")
+	host := flag.String("host", "0.0.0.0", "address to bind when no --listen is given")
+	port := flag.Int("port", 4221, "port to bind when no --listen is given")
+	flag.Var(&cfg.Listen, "listen", "host:port to accept connections on (repeatable; overrides --host and --port)")
+	flag.Var(&cfg.Headers, "header", "extra \"Name: Value\" header added to every response (repeatable)")
+	poweredBy := flag.String("powered-by", "", "value of an X-Powered-By header added to every response (omitted when empty)")
+	configFile := flag.String("config", "", "JSON file of flag values, keyed by flag name; flags given on the command line win")
+	flag.Parse()
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile); err != nil {
+			errorf("Error loading %s: %v", *configFile, err)
+			os.Exit(2)
+		}
+	}
+
+	limits := cfg.Limits
+	if limits.MaxRequestLine <= 0 || limits.MaxHeaderBytes <= 0 || limits.MaxHeaderCount <= 0 || limits.MaxBodyBytes <= 0 || limits.MaxChunkLine <= 0 {
+		errorf("Request size limits must all be positive")
+		os.Exit(2)
+	}
+	if cfg.ReadBuffer < 0 || cfg.WriteBuffer < 0 {
+		errorf("TCP buffer sizes must not be negative")
+		os.Exit(2)
+	}
+	if cfg.GzipLevel < 1 || cfg.GzipLevel > 9 {
+		errorf("--gzip-level must be between 1 and 9, not %d", cfg.GzipLevel)
+		os.Exit(2)
+	}
+	if cfg.MaxAnythingBody < 0 {
+		errorf("--max-anything-body must not be negative")
+		os.Exit(2)
+	}
+
+	if cfg.GetBody != "drain" && cfg.GetBody != "reject" {
+		errorf("--get-body must be drain or reject, not %q", cfg.GetBody)
+		os.Exit(2)
+	}
+	if *poweredBy != "" {
+		if err := cfg.Headers.Set("X-Powered-By: " + *poweredBy); err != nil {
+			errorf("Invalid --powered-by: %v", err)
+			os.Exit(2)
+		}
+	}
+	if *port < 0 || *port > 65535 {
+		errorf("Invalid port %d: must be between 0 and 65535", *port)
+		os.Exit(2)
+	}
+	for _, t := range strings.Split(*compressibleTypes, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			cfg.CompressibleTypes = append(cfg.CompressibleTypes, t)
+		}
+	}
+	cfg.Charsets = map[string]string{}
+	for _, pair := range strings.Split(*charsets, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		t, charset, found := strings.Cut(pair, "=")
+		if !found {
+			errorf("Invalid --charsets entry %q: expected type=charset", pair)
+			os.Exit(2)
+		}
+		cfg.Charsets[strings.ToLower(strings.TrimSpace(t))] = strings.TrimSpace(charset)
+	}
+	if len(cfg.Listen) == 0 {
+		cfg.Listen = listenFlag{net.JoinHostPort(*host, strconv.Itoa(*port))}
+	}
+	if strings.Trim(cfg.FilesPrefix, "/") == "" {
+		errorf("--files-prefix must name a path below /, not %q", cfg.FilesPrefix)
+		os.Exit(2)
+	}
+	cfg.FilesPrefix = "/" + strings.Trim(cfg.FilesPrefix, "/") + "/"
+	cfg.rootResponse = []byte(strings.TrimSuffix(sharedHeaders(rootResponse, cfg, false), "\r\n"))
+	return cfg
+}
+
+// applyConfigFile sets flags from a JSON object such as
+// {"directory": "/srv", "timeout": "30s", "header": ["X-A: 1"]}, skipping
+// any flag already given on the command line. Values go through the
+// flags' own parsing, so they're spelled exactly as on the command line;
+// arrays set a repeatable flag once per element.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written; a float64 would print 10485760 as 1.048576e+07.
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range values {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+		items, ok := value.([]any)
+		if !ok {
+			items = []any{value}
+		}
+		for _, item := range items {
+			if err := flag.Set(name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cachedResponse is the body served by /cache. It is generated on first use
+// and then reused, with Age reporting how long ago that happened.
+var cachedResponse struct {
+	once        sync.Once
+	body        string
+	generatedAt time.Time
+}
+
+func cacheBody() (string, time.Duration) {
+	cachedResponse.once.Do(func() {
+		cachedResponse.generatedAt = time.Now()
+		cachedResponse.body = "generated at " + cachedResponse.generatedAt.UTC().Format(time.RFC1123)
+	})
+	return cachedResponse.body, time.Since(cachedResponse.generatedAt)
+}
+
+// serverVersion is advertised in the Server header of every response.
+const serverVersion = "0.1.0"
+
+// startedAt is when the server came up, which is as far back as the output
+// of the fixed endpoints like /echo goes.
+var startedAt = time.Now()
+
+// httpDate formats t as an HTTP date (RFC 9110's IMF-fixdate).
+func httpDate(t time.Time) string {
+	return t.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+}
+
+// withLastModified stamps a successful response from one of the fixed
+// endpoints with the server's start time, so clients can revalidate it.
+func withLastModified(res string) string {
+	if status := responseStatus(res); status < 200 || status >= 300 {
+		return res
+	}
+	return withHeader(res, "Last-Modified", httpDate(startedAt))
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange resolves a single "bytes=start-end" Range header against a
+// body of the given size, returning the inclusive byte offsets. ok is false
+// when the header is absent or malformed and the full body should be sent.
+func parseRange(header string, size int) (start, end int, ok bool, err error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// Suffix range: the final N bytes.
+		n, convErr := strconv.Atoi(last)
+		if convErr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+
+	start, convErr := strconv.Atoi(first)
+	if convErr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if last != "" {
+		end, convErr = strconv.Atoi(last)
+		if convErr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
+
+// listen binds addr through a net.ListenConfig so socket options can be
+// applied before bind. The accept backlog is left to the runtime, which
+// already sizes it from net.core.somaxconn.
+func listen(cfg *Config, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReuseAddr(fd, cfg.ReuseAddr)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// chunkedWriter frames everything written to it as HTTP chunks.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// A zero-length chunk would terminate the body.
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(cw.w, "\r\n")
+	return n, err
+}
+
+// Close writes the terminating zero-size chunk.
+func (cw *chunkedWriter) Close() error {
+	_, err := io.WriteString(cw.w, "0\r\n\r\n")
+	return err
+}
+
+// streamEncoded writes a response whose body is compressed with coding as
+// it is sent, using chunked framing so nothing has to be buffered to learn
+// the length. head is the status line and headers, without any body
+// framing. HTTP/1.0 has no chunked framing, so callers must not use it
+// for those clients.
+func streamEncoded(conn net.Conn, req *Request, cfg *Config, head string, body io.Reader, coding string) {
+	head = withHeader(head, "Content-Encoding", coding)
+	out := &deadlineWriter{conn: conn, cfg: cfg}
+	head = withHeader(head, "Transfer-Encoding", "chunked")
+	if _, err := io.WriteString(out, finishResponse(head, req, cfg, wantsClose(req, cfg))); err != nil {
+		debugf("Error writing response: %v", err)
+		req.closeConn = true
+		return
+	}
+	if req.Method == "HEAD" {
+		return
+	}
+	cw := &chunkedWriter{w: out}
+	// Buffer ahead of the chunker so the encoder's small writes don't each
+	// become a chunk of their own.
+	bw := bufio.NewWriter(cw)
+	zw := newEncoder(bw, coding, cfg.GzipLevel)
+	defer releaseEncoder(zw, coding, cfg.GzipLevel)
+	if _, err := io.Copy(zw, body); err != nil {
+		debugf("Error writing response: %v", err)
+		req.closeConn = true
+		return
+	}
+	if err := zw.Close(); err != nil {
+		debugf("Error writing response: %v", err)
+		req.closeConn = true
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		debugf("Error writing response: %v", err)
+		req.closeConn = true
+		return
+	}
+	cw.Close()
 }
 
 func main() {
-	fmt.Println("Logs from your program will appear here!")
+	cfg := parseFlags()
+	infof("Logs from your program will appear here!")
+	if cfg.DebugCapture > 0 {
+		captures = newCaptureRing(cfg.DebugCapture)
+	}
 
-	dir := ""
-	if len(os.Args) == 3 {
-		dir = os.Args[2]
+	infof("Using dir: %s", cfg.Dir)
+	infof("Serving files under: %s", cfg.FilesPrefix)
+	// Bind everything before serving anything, so a bad address fails
+	// startup instead of leaving the server half up.
+	var listeners []net.Listener
+	for _, addr := range cfg.Listen {
+		l, err := listen(cfg, addr)
+		if err != nil {
+			errorf("Failed to bind to %s: %v", addr, err)
+			os.Exit(1)
+		}
+		infof("Listening on %s", l.Addr())
+		listeners = append(listeners, l)
 	}
 
-	fmt.Printf("Using dir: %s\n", dir)
-	l, err := net.Listen("tcp", "0.0.0.0:4221")
+	router, err := routes(cfg)
 	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
-		os.Exit(1)
+		errorf("%v", err)
+		os.Exit(2)
+	}
+	var limiter *ipLimiter
+	if cfg.MaxConnsPerIP > 0 {
+		limiter = newIPLimiter(cfg.MaxConnsPerIP)
 	}
 
+	// Every listener feeds the same handler; if any of them fails the
+	// whole server goes down rather than carrying on with fewer.
+	for _, l := range listeners[1:] {
+		go serve(l, cfg, router, limiter)
+	}
+	serve(listeners[0], cfg, router, limiter)
+}
+
+// serve runs the accept loop for one listener.
+func serve(l net.Listener, cfg *Config, router *Router, limiter *ipLimiter) {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+			errorf("Error accepting connection on %s: %v", l.Addr(), err)
 			os.Exit(1)
 		}
-		go handleRequest(conn, dir)
+		setBufferSizes(conn, cfg)
+		if limiter == nil {
+			go handleRequest(conn, cfg, router)
+			continue
+		}
+		if !limiter.acquire(conn.RemoteAddr()) {
+			warnf("Rejecting connection from %s: %d already open", conn.RemoteAddr(), cfg.MaxConnsPerIP)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer limiter.release(conn.RemoteAddr())
+			handleRequest(conn, cfg, router)
+		}()
 	}
+}
 
+// setBufferSizes applies --tcp-read-buffer and --tcp-write-buffer. A failure
+// only costs throughput, so it's logged and the connection served anyway.
+func setBufferSizes(conn net.Conn, cfg *Config) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if cfg.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			warnf("Error setting read buffer on %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+	if cfg.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(cfg.WriteBuffer); err != nil {
+			warnf("Error setting write buffer on %s: %v", conn.RemoteAddr(), err)
+		}
+	}
 }
 
-func handleRequest(conn net.Conn, dir string) {
+func handleRequest(conn net.Conn, cfg *Config, router *Router) {
 	defer conn.Close()
-	buf := make([]byte, 1024)
+	reader := bufio.NewReader(conn)
 	for {
-		_, err := conn.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println("Error reading request:", err)
+		var res string
+		connectionClose := false
+		setReadDeadline(conn, cfg)
+		req, err := readRequest(conn, reader, cfg)
+		if err == io.EOF {
+			return
+		} else if isTimeout(err) && errors.Is(err, errIncompleteRequest) {
+			warnf("Timed out reading request: %v", err)
+			res = errorResponse(nil, cfg, 408, "the request did not arrive in time")
+			connectionClose = true
+		} else if status := requestErrorStatus(err); status != 0 {
+			warnf("Error parsing request: %v", err)
+			res = errorResponse(nil, cfg, status, err.Error())
+			// Whatever is left of the request is still unread.
+			connectionClose = true
+		} else if err != nil {
+			// A timeout before any byte arrived means the connection sat
+			// idle; that's routine, but worth seeing when tuning --timeout.
+			if isTimeout(err) {
+				infof("Closing idle connection from %s after %s", conn.RemoteAddr(), cfg.Timeout)
+			} else {
+				errorf("Error reading request: %v", err)
 			}
 			return
-		}
-		req := strings.Split(string(buf), "\r\n")
-		userAgent := ""
-		connectionClose := false
-		requestType := strings.Split(req[0], " ")[0]
-		fmt.Println("Request type: ", requestType)
-
-		for i := range req {
-			if len(req[i]) > 0 {
-				if strings.HasPrefix(req[i], "User-Agent:") {
-					userAgent = strings.SplitN(req[i], ": ", 2)[1]
-				}
-				if strings.HasPrefix(req[i], "Connection:") && strings.Contains(strings.ToLower(req[i]), "close") {
+		} else {
+			debugf("Request received: %s %s %s", req.Method, req.Path, req.Version)
+			for name, value := range req.Headers {
+				debugf("Header: %s: %s", name, value)
+			}
+			connectionClose = wantsClose(req, cfg)
+			cancel := func() {}
+			if cfg.MaxDuration > 0 {
+				req.ctx, cancel = context.WithTimeout(context.Background(), cfg.MaxDuration)
+				req.Body = &contextReader{ctx: req.ctx, r: req.Body}
+			}
+			if req.Path == "/" && (req.Method == "GET" || req.Method == "HEAD") && !connectionClose && req.Version == "HTTP/1.1" {
+				setWriteDeadline(conn, cfg)
+				res := append(cfg.rootResponse[:len(cfg.rootResponse):len(cfg.rootResponse)], "Date: "+httpDate(time.Now())+"\r\n\r\n"...)
+				if _, err := conn.Write(res); err != nil {
+					debugf("Error writing response: %v", err)
 					connectionClose = true
 				}
 			} else {
-				continue
+				res = router.ServeConn(conn, req, cfg)
+				if req.Method == "HEAD" {
+					// Handlers answer HEAD as they would GET; the headers,
+					// Content-Length included, describe the body we drop.
+					res = withoutBody(res)
+				}
+				if responseStatus(res) >= 500 || req.closeConn {
+					// After a server error, or a streamed response cut short, we
+					// can't vouch for the connection state, so don't reuse it.
+					connectionClose = true
+				}
 			}
-			fmt.Printf("Request received: %s\n", req[i])
+			if err := req.finish(conn); err != nil {
+				// Without the rest of the body there's no finding where the
+				// next request starts.
+				debugf("Error draining request body: %v", err)
+				connectionClose = true
+			}
+			cancel()
 		}
-		path := strings.Split(req[0], " ")[1]
-		var res string
 
-		if path == "/" {
-			res = "HTTP/1.1 200 OK\r\n\r\n"
-		} else if path[:5] == "/echo" {
-			pathStr := strings.Split(path, "/")[len(strings.Split(path, "/"))-1]
-			encoding := ""
-			for _, line := range req {
-				if strings.HasPrefix(line, "Accept-Encoding:") {
-					parts := strings.SplitN(line, ": ", 2)
-					if len(parts) == 2 {
-						encoding = parts[1]
-					}
-					break
-				}
-			}
-			encoding_list := strings.Split(encoding, ", ")
-			for i := range encoding_list {
-				if encoding_list[i] == "gzip" {
-					encoding = encoding_list[i]
+		if res != "" {
+			// An empty response means the handler already streamed its own.
+			setWriteDeadline(conn, cfg)
+			if _, err := conn.Write([]byte(finishResponse(res, req, cfg, connectionClose))); err != nil {
+				if isTimeout(err) {
+					warnf("Timed out writing response to %s", conn.RemoteAddr())
+				} else {
+					// Usually the client hung up; that's no reason to make
+					// noise.
+					debugf("Error writing response: %v", err)
 				}
+				return
 			}
-			if encoding != "gzip" {
+		}
+		if connectionClose {
+			return
+		}
+	}
+}
 
-				res = fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(pathStr), pathStr)
-			} else {
-				compressedData := comperessData(pathStr)
-				headers := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n", compressedData.Len())
-				conn.Write([]byte(headers))
-				conn.Write(compressedData.Bytes())
-				//res = fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s", encoding, compressedData.Len(), compressedData)
-				conn.Close()
-				return
+// routes registers the server's handlers. The files route is mounted last,
+// at --files-prefix, and fails if it would overlap one of the others.
+func routes(cfg *Config) (*Router, error) {
+	rt := newRouter()
+	rt.Handle("/", handleRootRequest)
+	echo := func(conn net.Conn, req *Request, cfg *Config) string {
+		return withLastModified(handleEchoRequest(conn, req, cfg))
+	}
+	rt.Handle("/echo/", echo)
+	rt.Handle("/cache", handleCacheRequest)
+	if captures != nil {
+		rt.Handle("/debug/requests", handleDebugRequests)
+	}
+	rt.Handle("/anything", handleAnythingRequest)
+	rt.Handle("/anything/", handleAnythingRequest)
+	rt.Handle("/redirect/", func(conn net.Conn, req *Request, cfg *Config) string {
+		return withLastModified(handleRedirectRequest(conn, req, cfg))
+	})
+	rt.Handle("/basic-auth/", handleBasicAuthRequest)
+	rt.Handle("/cookies/set", handleSetCookiesRequest)
+	rt.Handle("/cookies", handleCookiesRequest)
+	rt.Handle("/ip", handleIPRequest)
+	rt.Handle("/get", handleGetRequest)
+	rt.Handle("/robots.txt", func(conn net.Conn, req *Request, cfg *Config) string {
+		return serveConfiguredFile(req, cfg, cfg.RobotsFile)
+	})
+	rt.Handle("/.well-known/security.txt", func(conn net.Conn, req *Request, cfg *Config) string {
+		return serveConfiguredFile(req, cfg, cfg.SecurityFile)
+	})
+	rt.Handle("/user-agent", handleUserAgentRequest)
+	if pattern, ok := rt.overlap(cfg.FilesPrefix); ok {
+		return nil, fmt.Errorf("--files-prefix %s overlaps the %s route", strings.TrimSuffix(cfg.FilesPrefix, "/"), pattern)
+	}
+	rt.Handle(cfg.FilesPrefix, func(conn net.Conn, req *Request, cfg *Config) string {
+		return fileHeaders(handleFileRequest(conn, req, cfg), cfg)
+	})
+	return rt, nil
+}
+
+// handleDebugRequests shows the raw requests kept by --debug-capture.
+func handleDebugRequests(conn net.Conn, req *Request, cfg *Config) string {
+	contentType, res := textContentType(req, cfg)
+	if res != "" {
+		return res
+	}
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	rw.WriteString(captures.dump())
+	return rw.String()
+}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// errorResponse builds the response for an error status such as 404.
+// With --problem-json, clients that accept application/problem+json get a
+// problem details body; everyone else gets the bare status and an explicit
+// Content-Length: 0, which strict clients want even on a bodiless reply.
+// req may be nil when the request failed to parse.
+func errorResponse(req *Request, cfg *Config, code int, detail string) string {
+	rw := &responseWriter{}
+	rw.WriteHeader(code)
+	if !cfg.ProblemJSON || req == nil || !strings.Contains(req.Header("Accept"), "application/problem+json") {
+		return rw.String()
+	}
+
+	body, err := json.Marshal(problem{Type: "about:blank", Title: statusText(code), Status: code, Detail: detail})
+	if err != nil {
+		return rw.String()
+	}
+	rw.SetHeader("Content-Type", "application/problem+json")
+	rw.Write(body)
+	return rw.String()
+}
+
+// requestErrorStatus maps a readRequest failure to the status to reply
+// with, or 0 when there is nothing useful to say and the connection should
+// just be dropped.
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRequestLineTooLong):
+		return 414
+	case errors.Is(err, errHeadersTooLarge):
+		return 431
+	case errors.Is(err, errBodyTooLarge):
+		return 413
+	case errors.Is(err, errLengthRequired):
+		return 411
+	case errors.Is(err, errUnsupportedTransferCoding):
+		return 501
+	case errors.Is(err, errMalformedRequest):
+		return 400
+	}
+	return 0
+}
+
+// bodyErrorResponse answers a request whose body failed partway through a
+// handler reading it.
+func bodyErrorResponse(req *Request, cfg *Config, err error) string {
+	warnf("Error reading request body: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorResponse(req, cfg, 503, "the request took too long to handle")
+	}
+	if isTimeout(err) {
+		return errorResponse(req, cfg, 408, "the request body did not arrive in time")
+	}
+	if status := requestErrorStatus(err); status != 0 {
+		return errorResponse(req, cfg, status, err.Error())
+	}
+	return errorResponse(req, cfg, 400, "the request body could not be read")
+}
+
+// qValue reads the q parameter from the part of an Accept-style list
+// entry after its first ';', defaulting to 1.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return q
 			}
-		} else if path[:6] == "/files" {
-			fileName := strings.Split(path, "/")[len(strings.Split(path, "/"))-1]
-			filePath := fmt.Sprintf("%s%s", dir, fileName)
-			fmt.Printf("File Path: %s\n", filePath)
-
-			if requestType == "GET" {
-				fileContent, err := os.ReadFile(filePath)
-				if err != nil {
-					res = "HTTP/1.1 404 Not Found\r\n\r\n"
-				} else {
-					res = fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n%s", len(fileContent), fileContent)
+		}
+	}
+	return 1
+}
 
-				}
-			} else {
-				postData := req[len(req)-1]
-				postData = strings.TrimRight(postData, "\x00 \n\r\t")
-				fmt.Printf("Post Data: %s\n", postData)
-				os.WriteFile(filePath, []byte(postData), 0644)
-				res = "HTTP/1.1 201 Created\r\n\r\n"
+// textContentType negotiates the Content-Type of a text/plain response.
+// Everything here is UTF-8, so the only question is whether the client
+// takes it: when Accept-Charset rules UTF-8 out (q=0, directly or through
+// "*") the text can't be sent and res is a 406 instead. Clients that send
+// no Accept-Charset get a bare text/plain as before.
+func textContentType(req *Request, cfg *Config) (contentType, res string) {
+	header := req.Header("Accept-Charset")
+	if header == "" {
+		return "text/plain", ""
+	}
+	utf8Q, wildcardQ := -1.0, -1.0
+	for _, entry := range strings.Split(header, ",") {
+		charset, params, _ := strings.Cut(entry, ";")
+		q := qValue(params)
+		switch strings.ToLower(strings.TrimSpace(charset)) {
+		case "utf-8", "utf8":
+			utf8Q = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+	if utf8Q == 0 || (utf8Q < 0 && wildcardQ == 0) {
+		return "", errorResponse(req, cfg, 406, "only utf-8 text is available")
+	}
+	return "text/plain; charset=utf-8", ""
+}
+
+// setReadDeadline gives the client cfg.Timeout from now to deliver the
+// next request in full.
+func setReadDeadline(conn net.Conn, cfg *Config) {
+	if cfg.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
+	}
+}
+
+// setWriteDeadline gives the client cfg.Timeout from now to accept the
+// next write.
+func setWriteDeadline(conn net.Conn, cfg *Config) {
+	if cfg.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(cfg.Timeout))
+	}
+}
+
+// deadlineWriter renews the write deadline before every write, so a
+// streamed response is cut off when the client stops reading, not merely
+// because it is large.
+type deadlineWriter struct {
+	conn net.Conn
+	cfg  *Config
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	setWriteDeadline(d.conn, d.cfg)
+	return d.conn.Write(p)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// wantsClose reports whether the connection ends after this request:
+// HTTP/1.1 connections persist unless the client says close, HTTP/1.0 ones
+// only when it asks for keep-alive.
+func wantsClose(req *Request, cfg *Config) bool {
+	if req.closeConn {
+		return true
+	}
+	connection := strings.ToLower(req.Header("Connection"))
+	if req.Version == "HTTP/1.0" {
+		return cfg.NoKeepAlive || !strings.Contains(connection, "keep-alive")
+	}
+	return cfg.NoKeepAlive || strings.Contains(connection, "close")
+}
+
+// finishResponse adds the headers shared by every response: Server,
+// Connection: close when the connection is about to be dropped, the
+// operator's --header values, then the Date. An HTTP/1.0 connection that
+// stays open is confirmed with Connection: keep-alive, since a 1.0 client
+// only keeps it if we say so. req is nil when the request failed to parse.
+func finishResponse(res string, req *Request, cfg *Config, connectionClose bool) string {
+	res = sharedHeaders(res, cfg, connectionClose)
+	if req != nil && req.Version == "HTTP/1.0" && !connectionClose {
+		res = withHeader(res, "Connection", "keep-alive")
+	}
+	return withHeader(res, "Date", httpDate(time.Now()))
+}
+
+// sharedHeaders is finishResponse without the Date, for responses built
+// ahead of time.
+func sharedHeaders(res string, cfg *Config, connectionClose bool) string {
+	if !cfg.Headers.has("Server") {
+		res = withHeader(res, "Server", "httpgo/"+serverVersion)
+	}
+	if connectionClose {
+		res = withHeader(res, "Connection", "close")
+	}
+	for _, header := range cfg.Headers {
+		res = withHeader(res, header.Name, header.Value)
+	}
+	return res
+}
+
+// responseStatus returns the status code of a raw response, or 0 if it has
+// no parseable status line.
+func responseStatus(res string) int {
+	_, rest, _ := strings.Cut(res, " ")
+	code, err := strconv.Atoi(strings.SplitN(rest, " ", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// withoutBody cuts a raw response down to its status line and headers.
+func withoutBody(res string) string {
+	head, _, found := strings.Cut(res, "\r\n\r\n")
+	if !found {
+		return res
+	}
+	return head + "\r\n\r\n"
+}
+
+// withHeader appends a header line to the header block of a raw response.
+func withHeader(res, name, value string) string {
+	return strings.Replace(res, "\r\n\r\n", "\r\n"+name+": "+value+"\r\n\r\n", 1)
+}
+
+var rootResponse = (&responseWriter{}).String()
+
+// handleRootRequest only runs for requests that close the connection or
+// use another method; keep-alive GETs and HEADs for / are answered from
+// cfg.rootResponse.
+func handleRootRequest(conn net.Conn, req *Request, cfg *Config) string {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		res := errorResponse(req, cfg, 405, req.Method+" is not supported on /")
+		return withHeader(res, "Allow", "GET, HEAD")
+	}
+	return rootResponse
+}
+
+// selectEncoding picks the content coding for a response from the
+// client's Accept-Encoding: whichever of gzip, deflate and identity it
+// weights highest, preferring them in that order on a tie. Unlisted codings
+// take the weight of "*" if there is one; otherwise only identity is
+// acceptable unlisted, and only as a last resort. It returns "" when every
+// supported coding has been ruled out with q=0, which calls for a 406.
+func selectEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" {
+			weights[coding] = qValue(params)
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate", "identity"} {
+		q, listed := weights[coding]
+		if !listed {
+			if wildcard, ok := weights["*"]; ok {
+				q = wildcard
+			} else if coding == "identity" {
+				q = 0.001
 			}
-		} else if len(path) < 11 {
-			res = "HTTP/1.1 404 Not Found\r\n\r\n"
-		} else if path[:11] == "/user-agent" {
-			fmt.Printf("Here-Here %s\n", userAgent)
-			res = fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(userAgent), userAgent)
-		} else {
-			res = "HTTP/1.1 404 Not Found\r\n\r\n"
 		}
-		if connectionClose {
-			res = strings.Replace(res, "\r\n\r\n", "\r\nConnection: close\r\n\r\n", 1)
+		if q > bestQ {
+			best, bestQ = coding, q
 		}
+	}
+	return best
+}
 
-		conn.Write([]byte(res))
-		if connectionClose {
-			//conn.Write([]byte(res))
-			conn.Close()
-			return
+// compressible reports whether responses of contentType are worth gzipping,
+// per --compressible-types. Entries like "text/*" cover a whole type.
+func compressible(cfg *Config, contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, t := range cfg.CompressibleTypes {
+		if t == mediaType || t == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+func handleEchoRequest(conn net.Conn, req *Request, cfg *Config) string {
+	pathStr := strings.Split(req.Path, "/")[len(strings.Split(req.Path, "/"))-1]
+	contentType, res := textContentType(req, cfg)
+	if res != "" {
+		return res
+	}
+	encoding := selectEncoding(req.Header("Accept-Encoding"))
+	if encoding == "" {
+		return errorResponse(req, cfg, 406, "no acceptable content coding")
+	}
+
+	if pathStr == "" && cfg.EmptyEcho204 {
+		return (&responseWriter{code: 204}).String()
+	}
+
+	start, end, partial, rangeErr := parseRange(req.Header("Range"), len(pathStr))
+	if cfg.MaxEchoLength > 0 && len(pathStr) > cfg.MaxEchoLength {
+		warnf("Rejecting echo of %d bytes (limit %d)", len(pathStr), cfg.MaxEchoLength)
+		return errorResponse(req, cfg, 400, fmt.Sprintf("echo is limited to %d bytes", cfg.MaxEchoLength))
+	} else if rangeErr != nil {
+		res := errorResponse(req, cfg, 416, rangeErr.Error())
+		return withHeader(res, "Content-Range", fmt.Sprintf("bytes */%d", len(pathStr)))
+	} else if partial {
+		// Ranges are served from the identity body, never a compressed one.
+		rw := &responseWriter{}
+		rw.WriteHeader(206)
+		rw.SetHeader("Content-Type", contentType)
+		rw.SetHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(pathStr)))
+		rw.WriteString(pathStr[start : end+1])
+		return rw.String()
+	}
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	if encoding == "identity" || !compressible(cfg, contentType) || len(pathStr) < cfg.GzipMin {
+		// Below --gzip-min, compressing isn't worth the CPU.
+		rw.WriteString(pathStr)
+		return rw.String()
+	}
+	// The echo is already in memory, so compress it whole and check that
+	// it shrank before committing to a coding.
+	compressedData := compressData(pathStr, encoding, cfg.GzipLevel)
+	if len(compressedData) >= len(pathStr) {
+		// The coding's framing outweighs any savings on short or random input.
+		rw.WriteString(pathStr)
+		return rw.String()
+	}
+	rw.SetHeader("Content-Encoding", encoding)
+	rw.WriteString(compressedData)
+	return rw.String()
+}
+
+func handleCacheRequest(conn net.Conn, req *Request, cfg *Config) string {
+	contentType, res := textContentType(req, cfg)
+	if res != "" {
+		return res
+	}
+	body, age := cacheBody()
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	rw.SetHeader("Age", strconv.Itoa(int(age.Seconds())))
+	rw.WriteString(body)
+	return rw.String()
+}
+
+// serveConfiguredFile serves one of the operator-supplied text files such as
+// --robots. Routes whose file isn't configured simply don't exist.
+func serveConfiguredFile(req *Request, cfg *Config, path string) string {
+	if path == "" {
+		return errorResponse(req, cfg, 404, req.Path+" is not configured")
+	}
+	contentType, res := textContentType(req, cfg)
+	if res != "" {
+		return res
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		errorf("Error reading %s for %s: %v", path, req.Path, err)
+		return errorResponse(req, cfg, 500, "could not read "+req.Path)
+	}
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	rw.Write(content)
+	return rw.String()
+}
+
+func handleFileRequest(conn net.Conn, req *Request, cfg *Config) string {
+	switch req.Method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE":
+	default:
+		res := errorResponse(req, cfg, 405, req.Method+" is not supported on files")
+		return withHeader(res, "Allow", "GET, HEAD, POST, PUT, DELETE")
+	}
+	fileName := strings.TrimPrefix(req.Path, cfg.FilesPrefix)
+	filePath := filepath.Join(cfg.Dir, filepath.FromSlash(fileName))
+	if req.Method == "GET" || req.Method == "HEAD" {
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			// Directories are served by their index.html, if they have one.
+			fileName = path.Join(fileName, "index.html")
+			filePath = filepath.Join(filePath, "index.html")
 		}
 	}
-	conn.Close()
+	debugf("File Path: %s", filePath)
+	if !withinDir(cfg.Dir, filePath) {
+		warnf("Refusing %s outside %s", filePath, cfg.Dir)
+		return errorResponse(req, cfg, 403, fileName+" is outside the served directory")
+	}
+
+	// Each connection has its own goroutine; without this, an upload and
+	// a delete of one name could race. Readers need no lock: an upload
+	// only replaces the file by renaming, so they see old or new whole.
+	if req.Method != "GET" && req.Method != "HEAD" {
+		defer lockFile(filePath)()
+	}
+
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return serveFile(conn, req, cfg, filePath, fileName)
+	}
+
+	if req.Method == "DELETE" {
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			// os.Remove would happily take an empty directory, the served
+			// one included.
+			return errorResponse(req, cfg, 403, "directories can't be deleted")
+		}
+		fileDigests.Delete(digestKey(filePath))
+		if err := os.Remove(filePath); errors.Is(err, fs.ErrNotExist) {
+			return errorResponse(req, cfg, 404, fileName+" does not exist")
+		} else if err != nil {
+			errorf("Error deleting file: %v", err)
+			return errorResponse(req, cfg, 500, "could not delete "+fileName)
+		}
+		return (&responseWriter{code: 204}).String()
+	}
+
+	// POST and PUT both upload.
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		return errorResponse(req, cfg, 403, "directories can't be overwritten")
+	}
+	if full, err := directoryFull(cfg, filePath); err != nil {
+		errorf("Error counting files: %v", err)
+		return errorResponse(req, cfg, 500, "could not inspect the serve directory")
+	} else if full {
+		return errorResponse(req, cfg, 507, fmt.Sprintf("the directory already holds %d files", cfg.MaxFiles))
+	}
+
+	want, err := digestSHA256(req.Header("Digest"))
+	if err != nil {
+		return errorResponse(req, cfg, 400, err.Error())
+	}
+	// A Digest covers the body as sent (RFC 3230), before any
+	// Content-Encoding is undone, so hash it ahead of the gunzipping.
+	sent := sha256.New()
+	raw := io.TeeReader(req.Body, sent)
+	var body io.Reader = raw
+	switch strings.ToLower(req.Header("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		// Store the file decompressed, gunzipping as it streams in. The
+		// body limit applies to what comes out, to stop gzip bombs.
+		limit := cfg.Limits.MaxBodyBytes
+		body = &maxBytesReader{r: &gzipBodyReader{r: body}, remaining: limit, limit: limit}
+	default:
+		return errorResponse(req, cfg, 415, "unsupported Content-Encoding "+req.Header("Content-Encoding"))
+	}
+	// Write beside the target and rename into place, so a reader never
+	// sees half a file and a failed upload leaves the old one untouched.
+	file, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		errorf("Error creating file: %v", err)
+		return errorResponse(req, cfg, 500, "could not create "+fileName)
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath) // a no-op once renamed
+	if cfg.ValidateUTF8 && declaresUTF8Text(req) {
+		body = &utf8Reader{r: body}
+	}
+	// Hash on the way through so the ETag costs no second read.
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), body)
+	if err != nil {
+		file.Close()
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			errorf("Error writing file: %v", err)
+			return errorResponse(req, cfg, 500, "could not write "+fileName)
+		}
+		return bodyErrorResponse(req, cfg, err)
+	}
+	if want != nil {
+		// The gzip reader may stop short of bytes trailing its stream.
+		if _, err := io.Copy(io.Discard, raw); err != nil {
+			file.Close()
+			return bodyErrorResponse(req, cfg, err)
+		}
+	}
+	if want != nil && !bytes.Equal(sent.Sum(nil), want) {
+		file.Close()
+		return errorResponse(req, cfg, 400, "body does not match its sha-256 Digest")
+	}
+	if err := file.Chmod(0o644); err != nil {
+		errorf("Error writing file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		errorf("Error writing file: %v", err)
+		return errorResponse(req, cfg, 500, "could not write "+fileName)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		errorf("Error renaming file: %v", err)
+		return errorResponse(req, cfg, 500, "could not write "+fileName)
+	}
+	recordDigest(filePath, hash.Sum(nil))
+	debugf("Wrote %d bytes to %s", n, filePath)
+	rw := &responseWriter{}
+	rw.WriteHeader(201)
+	rw.SetHeader("ETag", contentETag(hash.Sum(nil)))
+	return rw.String()
+}
+
+// fileLocks holds a mutex per absolute file path being written or deleted,
+// so changes to the same file are serialized while different files proceed
+// in parallel. An entry lives only while someone holds or awaits it.
+var fileLocks = struct {
+	sync.Mutex
+	m map[string]*fileLockEntry
+}{m: make(map[string]*fileLockEntry)}
+
+type fileLockEntry struct {
+	sync.Mutex
+	waiters int
+}
+
+// lockFile locks path and returns the function that unlocks it.
+func lockFile(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	fileLocks.Lock()
+	entry := fileLocks.m[path]
+	if entry == nil {
+		entry = &fileLockEntry{}
+		fileLocks.m[path] = entry
+	}
+	entry.waiters++
+	fileLocks.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		fileLocks.Lock()
+		if entry.waiters--; entry.waiters == 0 {
+			delete(fileLocks.m, path)
+		}
+		fileLocks.Unlock()
+	}
+}
+
+// withinDir reports whether path is dir itself or lies beneath it. A bare
+// prefix test isn't enough: /srv/www-secret starts with /srv/www.
+func withinDir(dir, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return absPath == absDir || strings.HasPrefix(absPath, strings.TrimSuffix(absDir, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// declaresUTF8Text reports whether req's Content-Type is text/* with
+// charset=utf-8.
+func declaresUTF8Text(req *Request) bool {
+	mediaType, params, err := mime.ParseMediaType(req.Header("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		return false
+	}
+	charset := strings.ToLower(params["charset"])
+	return charset == "utf-8" || charset == "utf8"
+}
+
+// digestSHA256 returns the sha-256 value of a Digest header (RFC 3230), or
+// nil when the header lists no sha-256. Other algorithms are ignored.
+func digestSHA256(header string) ([]byte, error) {
+	for _, item := range strings.Split(header, ",") {
+		alg, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		if !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("malformed sha-256 Digest %q", value)
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// serveFile streams a file to the client rather than holding all of it in
+// memory. HEAD gets exactly the headers GET would, and no body, without
+// the file being read. The ETag is the SHA-256 cached by fileDigests when
+// there is one, and a weak tag built from the size and modification time
+// otherwise; a full GET fills the cache as the file goes onto the wire.
+func serveFile(conn net.Conn, req *Request, cfg *Config, filePath, fileName string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errorResponse(req, cfg, 404, fileName+" does not exist")
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return errorResponse(req, cfg, 404, fileName+" does not exist")
+	}
+
+	etag := statETag(info)
+	// Reading through the request's context bounds the copy below by
+	// --max-request-duration, however slowly the client takes it.
+	var body io.Reader = &contextReader{ctx: req.Context(), r: file}
+	var hr *hashingReader
+	if sum, ok := cachedDigest(filePath, info); ok {
+		etag = contentETag(sum)
+	} else if req.Method == "GET" {
+		hr = &hashingReader{r: body, hash: sha256.New()}
+		body = hr
+		defer func() {
+			if hr.n == info.Size() {
+				storeDigest(filePath, info, hr.hash.Sum(nil))
+			}
+		}()
+	}
+
+	contentType := fileContentType(cfg, fileName)
+	encoding := selectEncoding(req.Header("Accept-Encoding"))
+	if encoding == "" {
+		return errorResponse(req, cfg, 406, "no acceptable content coding")
+	}
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	// HTTP/1.0 can't take a compressed file without it being buffered
+	// whole to learn its length, so those clients get the stored bytes.
+	if encoding != "identity" && compressible(cfg, contentType) && req.Version != "HTTP/1.0" {
+		// The compressed bytes differ from the stored ones, so they get
+		// their own tag.
+		rw.SetHeader("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+		streamEncoded(conn, req, cfg, fileHeaders(rw.head(), cfg), body, encoding)
+		return ""
+	}
+	rw.SetHeader("ETag", etag)
+	rw.SetHeader("Content-Length", strconv.FormatInt(info.Size(), 10))
+	head := fileHeaders(rw.head(), cfg)
+	out := &deadlineWriter{conn: conn, cfg: cfg}
+	if _, err := io.WriteString(out, finishResponse(head, req, cfg, wantsClose(req, cfg))); err != nil {
+		debugf("Error writing response: %v", err)
+		req.closeConn = true
+		return ""
+	}
+	if req.Method == "HEAD" {
+		return ""
+	}
+	if n, err := io.CopyN(out, body, info.Size()); err != nil {
+		// The headers promised more than we sent, so the connection can't
+		// carry another response.
+		debugf("Error sending %s after %d of %d bytes: %v", filePath, n, info.Size(), err)
+		req.closeConn = true
+	}
+	return ""
+}
+
+// fileContentType picks a file's Content-Type from its extension, falling
+// back to application/octet-stream for anything unrecognized. The charset
+// comes from --charsets, an exact type winning over its type/* entry,
+// rather than from the MIME table.
+func fileContentType(cfg *Config, name string) string {
+	mediaType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(name)), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	charset, ok := cfg.Charsets[mediaType]
+	if !ok {
+		charset = cfg.Charsets[major+"/*"]
+	}
+	if charset == "" {
+		return mediaType
+	}
+	return mediaType + "; charset=" + charset
+}
+
+// fileHeaders adds the headers every files route response carries.
+func fileHeaders(res string, cfg *Config) string {
+	if cfg.NoSniff {
+		// Uploads are arbitrary bytes; don't let a browser decide they're
+		// HTML.
+		res = withHeader(res, "X-Content-Type-Options", "nosniff")
+	}
+	return res
+}
+
+// fileDigests caches the SHA-256 of served files by absolute path. An entry
+// only counts while the file's size and modification time still match, so a
+// file changed behind the server's back is hashed afresh.
+var fileDigests sync.Map // string -> fileDigestEntry
+
+type fileDigestEntry struct {
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+func digestKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// recordDigest stores the SHA-256 of the file at path, as hashed while it
+// was written.
+func recordDigest(path string, sum []byte) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	fileDigests.Store(digestKey(path), fileDigestEntry{size: info.Size(), modTime: info.ModTime(), sum: sum})
+}
+
+// storeDigest stores the SHA-256 of the file at path, as hashed while it
+// was read after a stat returned info. It is dropped if the file has
+// changed since, as the bytes hashed may then be a mix of both versions.
+func storeDigest(path string, info fs.FileInfo, sum []byte) {
+	now, err := os.Stat(path)
+	if err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return
+	}
+	fileDigests.Store(digestKey(path), fileDigestEntry{size: info.Size(), modTime: info.ModTime(), sum: sum})
+}
+
+// cachedDigest returns the cached SHA-256 of the file at path, if there is
+// one still matching info.
+func cachedDigest(path string, info fs.FileInfo) ([]byte, bool) {
+	v, ok := fileDigests.Load(digestKey(path))
+	if !ok {
+		return nil, false
+	}
+	entry := v.(fileDigestEntry)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return entry.sum, true
+}
+
+// hashingReader hashes what is read through it, counting the bytes.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// statETag builds a weak ETag from a file's size and modification time, for
+// files whose digest isn't known yet.
+func statETag(info fs.FileInfo) string {
+	return `W/"` + strconv.FormatInt(info.Size(), 16) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + `"`
+}
+
+// contentETag formats a SHA-256 of a file's bytes as a strong ETag.
+func contentETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// directoryFull reports whether writing filePath would add a file beyond
+// --max-upload-files. Overwriting an existing file never counts against it.
+func directoryFull(cfg *Config, filePath string) (bool, error) {
+	if cfg.MaxFiles <= 0 {
+		return false, nil
+	}
+	if _, err := os.Stat(filePath); err == nil {
+		return false, nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return false, err
+	}
+	return len(entries) >= cfg.MaxFiles, nil
+}
+
+func handleUserAgentRequest(conn net.Conn, req *Request, cfg *Config) string {
+	contentType, res := textContentType(req, cfg)
+	if res != "" {
+		return res
+	}
+	rw := &responseWriter{}
+	rw.SetHeader("Content-Type", contentType)
+	rw.WriteString(req.Header("User-Agent"))
+	return rw.String()
 }
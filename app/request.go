@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+var (
+	errMalformedRequest          = errors.New("malformed request")
+	errUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+	errLineTooLong               = errors.New("line too long")
+	errRequestLineTooLong        = errors.New("request line too long")
+	errHeadersTooLarge           = errors.New("header section too large")
+	errBodyTooLarge              = errors.New("request body too large")
+	errLengthRequired            = errors.New("request body length required")
+	// errIncompleteRequest wraps read failures that happen after part of a
+	// request has already arrived.
+	errIncompleteRequest = errors.New("incomplete request")
+)
+
+// Request is a parsed HTTP request as seen by the handlers.
+type Request struct {
+	Method string
+	// Path is the percent-decoded path of the request target, without its
+	// query string.
+	Path string
+	// RawQuery is the query string as sent, without the '?'.
+	RawQuery string
+	// Query is RawQuery parsed and percent-decoded.
+	Query   url.Values
+	Version string
+	// Headers is keyed by canonical header name; use Header to look values up.
+	Headers map[string]string
+	// Body streams the decoded request body. Whatever a handler leaves
+	// unread is drained before the next request on the connection. Fields
+	// a chunked body declares in its Trailer header are added to Headers
+	// once Body has been read to the end.
+	Body io.Reader
+
+	// ctx carries the --max-request-duration deadline, when one is set.
+	ctx context.Context
+
+	// closeConn is set by handlers that stream their own response and fail
+	// partway, leaving the connection unusable, and for requests framed
+	// ambiguously enough that nothing after them can be trusted.
+	closeConn bool
+
+	// captured records the raw request for --debug-capture, when enabled.
+	captured *recordingReader
+}
+
+// Header returns the value of the named header, matching the name
+// case-insensitively.
+func (r *Request) Header(name string) string {
+	return r.Headers[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// Context returns the request's context, which is done once the request
+// has run past --max-request-duration. Long-running handlers should check it.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// readRequest reads the next request off the connection's buffered reader,
+// consuming exactly its bytes so anything pipelined behind it stays in r
+// for the next call. When nothing at all arrives it returns the bare read
+// error, io.EOF for a peer that closed cleanly between requests; failures
+// after the first byte wrap errIncompleteRequest.
+func readRequest(conn net.Conn, br *bufio.Reader, cfg *Config) (req *Request, err error) {
+	if _, err := br.Peek(1); err != nil {
+		return nil, err
+	}
+
+	var r byteReader = br
+	if captures != nil {
+		rec := &recordingReader{r: br}
+		r = rec
+		defer func() {
+			if err != nil {
+				captures.add(conn.RemoteAddr(), rec.buf.Bytes())
+			} else {
+				// Keep recording while the handler reads the body; the
+				// connection loop files it once the request is done.
+				req.captured = rec
+			}
+		}()
+	}
+
+	limits := &cfg.Limits
+	line, err := readLine(r, limits.MaxRequestLine)
+	for err == nil && line == "\r\n" {
+		// Tolerate stray CRLFs between pipelined requests.
+		line, err = readLine(r, limits.MaxRequestLine)
+	}
+	if errors.Is(err, errLineTooLong) {
+		return nil, errRequestLineTooLong
+	} else if err != nil {
+		return nil, lineError("request line", err)
+	}
+	method, target, version, err := parseRequestLine(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Keep whatever parsed; a stray '%' in one parameter shouldn't
+		// sink the request.
+		debugf("Ignoring malformed query %q: %v", rawQuery, err)
+	}
+
+	var lines []string
+	headerBytes := 0
+	for {
+		line, err := readLine(r, limits.MaxHeaderBytes-headerBytes)
+		if errors.Is(err, errLineTooLong) {
+			return nil, errHeadersTooLarge
+		} else if err != nil {
+			return nil, lineError("headers", err)
+		}
+		headerBytes += len(line)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if len(lines) == limits.MaxHeaderCount {
+			return nil, fmt.Errorf("%w: more than %d header lines", errHeadersTooLarge, limits.MaxHeaderCount)
+		}
+		lines = append(lines, line)
+	}
+	req = &Request{
+		Method:   method,
+		Path:     path,
+		RawQuery: rawQuery,
+		Query:    query,
+		Version:  version,
+	}
+	if req.Headers, err = parseHeaders(lines); err != nil {
+		return nil, err
+	}
+
+	if req.hasBody() && (req.Method == "GET" || req.Method == "HEAD") && cfg.GetBody == "reject" {
+		return nil, fmt.Errorf("%w: %s with a body", errMalformedRequest, req.Method)
+	}
+	// Framing and size are settled before any 100 Continue goes out, so a
+	// client is never invited to send a body that will be refused. That
+	// strips the framing headers, so check for a body first.
+	hasBody := req.hasBody()
+	req.Body, err = newBodyReader(r, req, &cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	// HTTP/1.0 has no 100 Continue (RFC 9110 section 10.1.1), so those
+	// clients are left to send the body unprompted.
+	if hasBody && req.Version == "HTTP/1.1" && strings.EqualFold(req.Header("Expect"), "100-continue") && br.Buffered() == 0 {
+		// The client is holding the body until we agree to take it.
+		// It has been waiting on us, so the body gets a fresh deadline.
+		setWriteDeadline(conn, cfg)
+		conn.Write([]byte((&responseWriter{code: 100}).String()))
+		setReadDeadline(conn, cfg)
+	}
+	return req, nil
+}
+
+// finish drains whatever body the handler left unread, so the reader is
+// positioned at the next request, and files the --debug-capture record.
+// A non-nil error means the connection's framing can't be trusted.
+func (r *Request) finish(conn net.Conn) error {
+	_, err := io.Copy(io.Discard, r.Body)
+	if r.captured != nil {
+		captures.add(conn.RemoteAddr(), r.captured.buf.Bytes())
+	}
+	return err
+}
+
+func (r *Request) hasBody() bool {
+	return r.Header("Transfer-Encoding") != "" || (r.Header("Content-Length") != "" && r.Header("Content-Length") != "0")
+}
+
+func parseRequestLine(line string) (method, path, version string, err error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+		return "", "", "", errMalformedRequest
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// parseHeaders builds the header map. A repeated field is joined into one
+// comma-separated value, as RFC 9110 section 5.3 allows; Cookie, whose
+// pairs are separated by semicolons, is joined with "; " instead. Whitespace
+// before the colon, and Content-Length values that disagree, are rejected:
+// a peer reading either differently could frame the request another way.
+func parseHeaders(lines []string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range lines {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		if name == "" || strings.TrimRight(name, " \t") != name {
+			return nil, fmt.Errorf("%w: bad header name %q", errMalformedRequest, name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		value = strings.TrimSpace(value)
+		prev, seen := headers[name]
+		switch {
+		case !seen:
+			headers[name] = value
+		case name == "Content-Length":
+			if value != prev {
+				return nil, fmt.Errorf("%w: conflicting Content-Length %q and %q", errMalformedRequest, prev, value)
+			}
+		case name == "Cookie":
+			headers[name] = prev + "; " + value
+		default:
+			headers[name] = prev + ", " + value
+		}
+	}
+	return headers, nil
+}
+
+// lineError classifies a readLine failure partway through a request: an
+// overlong line is malformed, anything else means the input stopped short.
+func lineError(what string, err error) error {
+	if errors.Is(err, errLineTooLong) {
+		return fmt.Errorf("%w: %s: %v", errMalformedRequest, what, err)
+	}
+	return fmt.Errorf("%w: %s: %w", errIncompleteRequest, what, err)
+}
+
+// readLine reads through the next '\n', failing with errLineTooLong once more
+// than max bytes have been consumed without finding it.
+func readLine(r io.ByteReader, max int) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) > max {
+			return "", errLineTooLong
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// responseWriter assembles a raw response for a handler to return. It
+// takes care of the status line and of Content-Length; the connection loop
+// adds Date, Server and the other headers every response shares.
+type responseWriter struct {
+	code    int
+	headers []responseHeader
+	body    bytes.Buffer
+}
+
+// SetHeader sets a header, replacing any earlier value under the same
+// name. Headers are sent in the order they were first set, spelled as
+// given.
+func (w *responseWriter) SetHeader(name, value string) {
+	for i := range w.headers {
+		if strings.EqualFold(w.headers[i].Name, name) {
+			w.headers[i].Value = value
+			return
+		}
+	}
+	w.headers = append(w.headers, responseHeader{Name: name, Value: value})
+}
+
+// WriteHeader sets the status code, 200 unless it is called.
+func (w *responseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+// Write appends to the body.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// WriteString appends to the body.
+func (w *responseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// head returns the status line and headers, ending in the blank line.
+// Content-Length is left to the caller, for responses streamed with
+// framing of their own.
+func (w *responseWriter) head() string {
+	code := w.code
+	if code == 0 {
+		code = 200
+	}
+	var b strings.Builder
+	b.WriteString(statusLine(code))
+	for _, header := range w.headers {
+		b.WriteString(header.Name + ": " + header.Value + "\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// String returns the finished response. Content-Length is filled in from
+// the body unless a handler set it itself, as a HEAD reply describing a
+// body it doesn't send does; 1xx and 204 responses never carry one.
+func (w *responseWriter) String() string {
+	if w.code != 204 && w.code/100 != 1 && !headerFlag(w.headers).has("Content-Length") {
+		w.SetHeader("Content-Length", strconv.Itoa(w.body.Len()))
+	}
+	return w.head() + w.body.String()
+}
+
+// statusTexts holds the reason phrases of the codes the server sends.
+var statusTexts = map[int]string{
+	100: "Continue",
+	200: "OK",
+	201: "Created",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	408: "Request Timeout",
+	411: "Length Required",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+	507: "Insufficient Storage",
+}
+
+// statusText returns the reason phrase for code, falling back to the name
+// of its class for codes missing from statusTexts.
+func statusText(code int) string {
+	if text, ok := statusTexts[code]; ok {
+		return text
+	}
+	switch code / 100 {
+	case 1:
+		return "Informational"
+	case 2:
+		return "Success"
+	case 3:
+		return "Redirection"
+	case 4:
+		return "Client Error"
+	case 5:
+		return "Server Error"
+	}
+	return "Unknown Status"
+}
+
+// statusLine returns the HTTP/1.1 status line for code, CRLF included.
+func statusLine(code int) string {
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + statusText(code) + "\r\n"
+}
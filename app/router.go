@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HandlerFunc answers one request, returning the raw response to send, or
+// "" when it has already written its own.
+type HandlerFunc func(conn net.Conn, req *Request, cfg *Config) string
+
+type routeEntry struct {
+	pattern string
+	handler HandlerFunc
+}
+
+// Router dispatches requests to handlers by path. A pattern ending in "/"
+// matches everything under it, except "/" itself, which matches only the
+// root; any other pattern matches exactly.
+// An exact match wins over a prefix one, and a longer prefix over a
+// shorter one, so registration order doesn't matter.
+type Router struct {
+	exact  map[string]HandlerFunc
+	prefix []routeEntry
+}
+
+func newRouter() *Router {
+	return &Router{exact: make(map[string]HandlerFunc)}
+}
+
+// Handle registers handler for pattern.
+func (rt *Router) Handle(pattern string, handler HandlerFunc) {
+	if pattern == "/" || !strings.HasSuffix(pattern, "/") {
+		rt.exact[pattern] = handler
+		return
+	}
+	rt.prefix = append(rt.prefix, routeEntry{pattern: pattern, handler: handler})
+}
+
+// overlap reports a registered pattern that prefix, a pattern ending in
+// "/", would take paths from or lose them to, the root aside.
+func (rt *Router) overlap(prefix string) (string, bool) {
+	for pattern := range rt.exact {
+		if pattern != "/" && (strings.HasPrefix(pattern, prefix) || pattern+"/" == prefix) {
+			return pattern, true
+		}
+	}
+	for _, entry := range rt.prefix {
+		if strings.HasPrefix(entry.pattern, prefix) || strings.HasPrefix(prefix, entry.pattern) {
+			return entry.pattern, true
+		}
+	}
+	return "", false
+}
+
+// match finds the handler for path, or nil.
+func (rt *Router) match(path string) HandlerFunc {
+	if handler, ok := rt.exact[path]; ok {
+		return handler
+	}
+	var best *routeEntry
+	for i, entry := range rt.prefix {
+		if strings.HasPrefix(path, entry.pattern) && (best == nil || len(entry.pattern) > len(best.pattern)) {
+			best = &rt.prefix[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.handler
+}
+
+// canonicalSlash returns the registered spelling of a path that only
+// misses a route by a trailing slash: "/cookies" for "/cookies/", or
+// "/files/" for "/files".
+func (rt *Router) canonicalSlash(path string) (string, bool) {
+	if rt.match(path) != nil {
+		return "", false
+	}
+	if trimmed, ok := strings.CutSuffix(path, "/"); ok && trimmed != "" {
+		if _, ok := rt.exact[trimmed]; ok {
+			return trimmed, true
+		}
+	}
+	for _, entry := range rt.prefix {
+		if path+"/" == entry.pattern {
+			return entry.pattern, true
+		}
+	}
+	return "", false
+}
+
+// ServeConn routes req to its handler. Paths a trailing slash away from a
+// route are redirected there under --strict-slash and served by it
+// otherwise.
+func (rt *Router) ServeConn(conn net.Conn, req *Request, cfg *Config) string {
+	if canonical, ok := rt.canonicalSlash(req.Path); ok {
+		if cfg.StrictSlash {
+			rw := &responseWriter{}
+			rw.WriteHeader(301)
+			rw.SetHeader("Location", (&url.URL{Path: canonical, RawQuery: req.RawQuery}).String())
+			return rw.String()
+		}
+		req.Path = canonical
+	}
+
+	if handler := rt.match(req.Path); handler != nil {
+		return handler(conn, req, cfg)
+	}
+	return errorResponse(req, cfg, 404, "no route matches "+req.Path)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// setReuseAddr is a no-op off Unix: Windows' SO_REUSEADDR lets another
+// socket steal a port in use, which is not what --reuseaddr asks for.
+func setReuseAddr(fd uintptr, reuse bool) error {
+	return nil
+}
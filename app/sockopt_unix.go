@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setReuseAddr sets SO_REUSEADDR on a socket that hasn't been bound yet.
+func setReuseAddr(fd uintptr, reuse bool) error {
+	value := 0
+	if reuse {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, value)
+}